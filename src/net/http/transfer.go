@@ -0,0 +1,331 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// registeredInMemoryReadersMu guards registeredInMemoryReaders.
+var registeredInMemoryReadersMu sync.RWMutex
+
+// registeredInMemoryReaders holds the checks installed by
+// RegisterInMemoryReader, consulted by isKnownInMemoryReader after its
+// built-in cases fail to match.
+var registeredInMemoryReaders []func(io.Reader) bool
+
+// RegisterInMemoryReader registers check as an additional way for
+// isKnownInMemoryReader to recognize reader types that are safe to read
+// more than once without blocking, such as a caller's own zero-copy
+// in-memory or memory-mapped Reader implementation. This lets Request.Write
+// and Transport avoid buffering request bodies of that type before a retry.
+//
+// check is only consulted for readers not already recognized by the
+// standard library (see isKnownInMemoryReader); it should report whether r
+// is safe to treat as such a reader.
+//
+// RegisterInMemoryReader is typically called from an init function and is
+// safe for concurrent use.
+func RegisterInMemoryReader(check func(io.Reader) bool) {
+	registeredInMemoryReadersMu.Lock()
+	defer registeredInMemoryReadersMu.Unlock()
+	registeredInMemoryReaders = append(registeredInMemoryReaders, check)
+}
+
+// isKnownInMemoryReader reports whether r is a type known to not
+// block on Read. Its caller uses this as an optional optimization
+// to send fewer TCP packets.
+//
+// This intentionally does not try to see through a plain *io.SectionReader
+// or *bufio.Reader: neither package exposes the reader wrapped underneath,
+// and reaching in via reflect+unsafe to read their unexported fields would
+// make this function brittle against internal layout changes in packages
+// this one doesn't control. A caller slicing or buffering a reader that is
+// itself already known to be in-memory can instead use
+// NewInMemorySectionReader or NewInMemoryBufioReader, which record that
+// fact at construction time, when the original reader is still at hand,
+// rather than asking isKnownInMemoryReader to reconstruct it later.
+func isKnownInMemoryReader(r io.Reader) bool {
+	switch r.(type) {
+	case *bytes.Reader, *bytes.Buffer, *strings.Reader,
+		*inMemorySectionReader, *inMemoryBufioReader:
+		return true
+	}
+	if ur, ok := unwrapNopCloser(r); ok {
+		return isKnownInMemoryReader(ur)
+	}
+
+	registeredInMemoryReadersMu.RLock()
+	checks := registeredInMemoryReaders
+	registeredInMemoryReadersMu.RUnlock()
+	for _, check := range checks {
+		if check(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// inMemorySectionReader wraps an *io.SectionReader known, at the point it
+// was constructed, to be slicing a reader isKnownInMemoryReader already
+// recognizes.
+type inMemorySectionReader struct {
+	*io.SectionReader
+}
+
+// NewInMemorySectionReader stands in for io.NewSectionReader for a caller
+// slicing a reader r that isKnownInMemoryReader already recognizes (e.g. a
+// *bytes.Reader, or one registered via RegisterInMemoryReader). The returned
+// reader reads and seeks exactly like the one io.NewSectionReader would
+// have returned, though it is typed as an io.ReadSeeker rather than an
+// *io.SectionReader, and isKnownInMemoryReader
+// also recognizes it, letting Request.Write and Transport apply their
+// retry-buffering optimizations to it the same way they would to r itself.
+//
+// Use io.NewSectionReader instead if r isn't already recognized that way;
+// wrapping the result here wouldn't change that, since there would be
+// nothing to record.
+func NewInMemorySectionReader(r io.ReaderAt, off, n int64) io.ReadSeeker {
+	sr := io.NewSectionReader(r, off, n)
+	if br, ok := r.(io.Reader); ok && isKnownInMemoryReader(br) {
+		return &inMemorySectionReader{sr}
+	}
+	return sr
+}
+
+// inMemoryBufioReader wraps a *bufio.Reader known, at the point it was
+// constructed, to be buffering a reader isKnownInMemoryReader already
+// recognizes.
+type inMemoryBufioReader struct {
+	*bufio.Reader
+}
+
+// NewInMemoryBufioReader stands in for bufio.NewReader for a caller
+// buffering a reader r that isKnownInMemoryReader already recognizes. It is
+// typed as an io.Reader rather than a *bufio.Reader, but the dynamic value
+// it returns has the same Read, ReadByte, ReadString, etc. methods
+// as the *bufio.Reader that bufio.NewReader would have returned, but unlike
+// that one, it's also recognized by isKnownInMemoryReader, letting
+// Request.Write and Transport apply their retry-buffering optimizations to
+// it the same way they would to r itself. See NewInMemorySectionReader for
+// why this is done at construction time instead of inside
+// isKnownInMemoryReader itself.
+//
+// Use bufio.NewReader instead if r isn't already recognized that way;
+// wrapping the result here wouldn't change that, since there would be
+// nothing to record.
+func NewInMemoryBufioReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if isKnownInMemoryReader(r) {
+		return &inMemoryBufioReader{br}
+	}
+	return br
+}
+
+// nopCloserType is the concrete (unexported) type returned by io.NopCloser
+// and, since Go 1.16, ioutil.NopCloser, which just forwards to it. It's
+// used by unwrapNopCloser to confirm r really is that wrapper before
+// unwrapping it, rather than unwrapping any struct that merely happens to
+// embed an io.Reader under the same field name.
+var nopCloserType = reflect.TypeOf(ioutil.NopCloser(io.Reader(nil)))
+
+// unwrapNopCloser reports whether r is an ioutil.NopCloser (or
+// io.NopCloser) wrapping another reader, peeling off one layer at a time
+// so callers that loop (as isKnownInMemoryReader does) see through any
+// number of stacked wrappers.
+func unwrapNopCloser(r io.Reader) (io.Reader, bool) {
+	if reflect.TypeOf(r) != nopCloserType {
+		return nil, false
+	}
+	fv := reflect.ValueOf(r).FieldByName("Reader")
+	if !fv.IsValid() || !fv.CanInterface() {
+		return nil, false
+	}
+	ur, ok := fv.Interface().(io.Reader)
+	return ur, ok
+}
+
+// transferWriter writes out the body of a Request or Response, choosing
+// among chunked, Content-Length-delimited, and identity (until EOF)
+// framing, and taking care to give the destination writer's ReadFrom (and
+// the body's own WriteTo) the best chance at a zero-copy sendfile-style
+// transfer.
+type transferWriter struct {
+	Method           string
+	Body             io.Reader
+	ContentLength    int64
+	TransferEncoding []string
+}
+
+// chunked reports whether te ends in "chunked".
+func chunked(te []string) bool {
+	return len(te) > 0 && te[len(te)-1] == "chunked"
+}
+
+// doBodyCopy copies src to dst, preferring whichever of src's WriteTo or
+// dst's ReadFrom is available so large bodies (notably *os.File) can take
+// the sendfile fast path instead of being copied through a buffer.
+func (t *transferWriter) doBodyCopy(dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, src)
+}
+
+// writeBody writes t.Body to w, framed according to t.TransferEncoding and
+// t.ContentLength.
+func (t *transferWriter) writeBody(w io.Writer) error {
+	if t.Body == nil {
+		return nil
+	}
+
+	body, bodyIsKnown := unwrapForWrite(t.Body)
+
+	switch {
+	case chunked(t.TransferEncoding):
+		cw := newChunkedWriter(w)
+		if _, err := t.doBodyCopy(cw, body); err != nil {
+			return err
+		}
+		return cw.Close()
+
+	case t.ContentLength == -1:
+		_, err := t.doBodyCopy(w, body)
+		return err
+
+	default:
+		// A caller's Body can opt into writing itself directly, bypassing
+		// the Content-Length LimitedReader wrap below. Types the standard
+		// library already recognizes (e.g. *bytes.Buffer) don't take this
+		// path: they keep going through the LimitedReader wrap so their
+		// existing ReadFrom-based behavior and tests are undisturbed.
+		if bw, ok := body.(io.WriterTo); ok && !bodyIsKnown {
+			n, err := bw.WriteTo(w)
+			if err != nil {
+				return err
+			}
+			if n != t.ContentLength {
+				return fmt.Errorf("http: ContentLength=%d with Body length %d", t.ContentLength, n)
+			}
+			return nil
+		}
+
+		lr := boundedForSendfile(body, t.ContentLength)
+		ncopy, err := t.doBodyCopy(w, lr)
+		if err != nil {
+			return err
+		}
+		// lr.R is the same underlying stream lr capped reads from; a Body
+		// longer than t.ContentLength still has bytes waiting on it, which
+		// boundedForSendfile's cap silently dropped from the copy above.
+		// Drain them here, uncapped, purely to learn whether they exist, so
+		// an oversized Body is reported as a mismatch instead of silently
+		// truncated. A Body made of *io.LimitedReader layers has had those
+		// layers collapsed away in lr, so their remaining limit is put back
+		// on the drain.
+		rest := lr.R
+		if _, ok := body.(*io.LimitedReader); ok {
+			rest = io.LimitReader(lr.R, boundedForSendfile(body, math.MaxInt64).N-ncopy)
+		}
+		nextra, err := io.Copy(ioutil.Discard, rest)
+		if err != nil {
+			return err
+		}
+		if n := ncopy + nextra; n != t.ContentLength {
+			return fmt.Errorf("http: ContentLength=%d with Body length %d", t.ContentLength, n)
+		}
+		return nil
+	}
+}
+
+// unwrapForWrite strips any number of ioutil.NopCloser wrappers from r,
+// reporting whether the innermost reader is one isKnownInMemoryReader
+// already has special handling for. On the Content-Length path, writeBody
+// only calls io.WriterTo directly for readers where this is false, so that
+// e.g. *bytes.Buffer keeps going
+// through the Content-Length LimitedReader path its existing callers and
+// tests already depend on.
+func unwrapForWrite(r io.Reader) (body io.Reader, known bool) {
+	for {
+		if ur, ok := unwrapNopCloser(r); ok {
+			r = ur
+			continue
+		}
+		return r, isKnownInMemoryReader(r)
+	}
+}
+
+// boundedForSendfile returns a single *io.LimitedReader of at most n bytes
+// reading from body, collapsing any nested io.LimitedReader wrapping (as a
+// caller might pass in directly) into one. body itself is left untouched
+// otherwise: in particular, an *io.SectionReader is passed straight
+// through rather than unwrapped, since there is no way to recover its
+// backing reader (and offset) without reaching into its unexported fields.
+// That means such a body won't reach the deepest sendfile fast path, but
+// it is read from the correct offset.
+//
+// The returned reader's R field is the same underlying stream the cap was
+// applied to; callers that need to detect a body longer than n can keep
+// reading from it afterward to find out. When body was itself an
+// *io.LimitedReader, R is the stream beneath it, which body's own limit no
+// longer bounds, so such a caller has to reapply that limit.
+func boundedForSendfile(body io.Reader, n int64) *io.LimitedReader {
+	base := body
+	haveLimit := false
+	var limit int64
+	for {
+		lr, ok := base.(*io.LimitedReader)
+		if !ok {
+			break
+		}
+		if !haveLimit || lr.N < limit {
+			limit = lr.N
+			haveLimit = true
+		}
+		base = lr.R
+	}
+	if haveLimit && limit < n {
+		n = limit
+	}
+	return &io.LimitedReader{R: base, N: n}
+}
+
+// chunkedWriter encodes writes to w as HTTP/1.1 chunks.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func newChunkedWriter(w io.Writer) *chunkedWriter {
+	return &chunkedWriter{w: w}
+}
+
+func (cw *chunkedWriter) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err = fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	if n, err = cw.w.Write(p); err != nil {
+		return n, err
+	}
+	if n != len(p) {
+		return n, io.ErrShortWrite
+	}
+	if _, err = io.WriteString(cw.w, "\r\n"); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (cw *chunkedWriter) Close() error {
+	_, err := io.WriteString(cw.w, "0\r\n")
+	return err
+}
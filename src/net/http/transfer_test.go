@@ -7,6 +7,7 @@ package http
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -69,6 +70,34 @@ func TestFinalChunkedBodyReadEOF(t *testing.T) {
 
 func TestDetectInMemoryReaders(t *testing.T) {
 	pr, _ := io.Pipe()
+
+	// namedType embeds an io.Reader under the field name "Reader", just
+	// like the unexported wrapper ioutil.NopCloser returns, but it isn't
+	// that wrapper and must not be treated as one.
+	type namedType struct {
+		io.Reader
+	}
+
+	type registeredType struct {
+		io.Reader
+	}
+
+	RegisterInMemoryReader(func(r io.Reader) bool {
+		_, ok := r.(*registeredType)
+		return ok
+	})
+
+	// A file isn't itself a type isKnownInMemoryReader recognizes, but (like
+	// bytes.Reader) it implements io.ReaderAt, so it can stand in for "a
+	// reader NewInMemorySectionReader slices that isn't already known to be
+	// in-memory" below.
+	f, err := ioutil.TempFile("", "net-http-testdetectinmemoryreaders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
 	tests := []struct {
 		r    io.Reader
 		want bool
@@ -84,6 +113,37 @@ func TestDetectInMemoryReaders(t *testing.T) {
 		{ioutil.NopCloser(bytes.NewReader(nil)), true},
 		{ioutil.NopCloser(bytes.NewBuffer(nil)), true},
 		{ioutil.NopCloser(strings.NewReader("")), true},
+
+		// Nested NopCloser wrapping.
+		{ioutil.NopCloser(ioutil.NopCloser(bytes.NewReader(nil))), true},
+		{ioutil.NopCloser(ioutil.NopCloser(pr)), false},
+
+		// A struct that merely happens to embed an io.Reader under the
+		// field name "Reader" is not an ioutil.NopCloser and must not be
+		// unwrapped.
+		{&namedType{pr}, false},
+
+		// A plain io.SectionReader or bufio.Reader is treated as opaque:
+		// there is no way to recover what they wrap without reaching into
+		// their unexported fields, so neither is reported as in-memory on
+		// its own, even when it happens to be backed by one.
+		{io.NewSectionReader(bytes.NewReader(nil), 0, 0), false},
+		{bufio.NewReader(bytes.NewBuffer(nil)), false},
+
+		// NewInMemorySectionReader and NewInMemoryBufioReader record, at
+		// construction time, that they're slicing/buffering a reader
+		// already known to be in-memory, so they are recognized...
+		{NewInMemorySectionReader(bytes.NewReader(nil), 0, 0), true},
+		{NewInMemoryBufioReader(bytes.NewBuffer(nil)), true},
+
+		// ...but not if the reader being sliced/buffered isn't itself
+		// already known to be in-memory: there's nothing to record.
+		{NewInMemorySectionReader(f, 0, 0), false},
+		{NewInMemoryBufioReader(pr), false},
+
+		// A reader opted in via RegisterInMemoryReader.
+		{&registeredType{bytes.NewReader(nil)}, true},
+		{NewInMemoryBufioReader(&registeredType{bytes.NewReader(nil)}), true},
 	}
 	for i, tt := range tests {
 		got := isKnownInMemoryReader(tt.r)
@@ -108,9 +168,27 @@ func (w *mockTransferWriterBodyWriter) Write(p []byte) (int, error) {
 	return ioutil.Discard.Write(p)
 }
 
+// writerToBody is a minimal Body implementation that opts into the
+// io.WriterTo fast path.
+type writerToBody struct {
+	data   []byte
+	called bool
+}
+
+func (b *writerToBody) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (b *writerToBody) WriteTo(w io.Writer) (int64, error) {
+	b.called = true
+	n, err := w.Write(b.data)
+	return int64(n), err
+}
+
 func TestTransferWriterWriteBodyReaderTypes(t *testing.T) {
 	fileTyp := reflect.TypeOf(&os.File{})
 	bufferTyp := reflect.TypeOf(&bytes.Buffer{})
+	sectionReaderTyp := reflect.TypeOf(&io.SectionReader{})
 
 	newFileFunc := func() (io.Reader, func(), error) {
 		f, err := ioutil.TempFile("", "net-http-testtransferwriterwritebodyreadertypes")
@@ -140,6 +218,24 @@ func TestTransferWriterWriteBodyReaderTypes(t *testing.T) {
 		return bytes.NewBuffer(make([]byte, 1024)), func() {}, nil
 	}
 
+	newSectionReaderOverFileFunc := func() (io.Reader, func(), error) {
+		f, cleanup, err := newFileFunc()
+		if err != nil {
+			return nil, nil, err
+		}
+		return io.NewSectionReader(f.(*os.File), 0, 1024), cleanup, nil
+	}
+
+	newLimitedReaderOverFileFunc := func() (io.Reader, func(), error) {
+		f, cleanup, err := newFileFunc()
+		if err != nil {
+			return nil, nil, err
+		}
+		// A caller-supplied io.LimitedReader, which writeBody collapses into
+		// its own Content-Length LimitedReader rather than nesting it.
+		return &io.LimitedReader{R: f, N: 1024}, cleanup, nil
+	}
+
 	cases := []struct {
 		Name             string
 		BodyFunc         func() (io.Reader, func(), error)
@@ -230,8 +326,51 @@ func TestTransferWriterWriteBodyReaderTypes(t *testing.T) {
 			TransferEncoding: []string{"chunked"},
 			ExpectedWrite:    true,
 		},
+		{
+			// The *io.SectionReader itself is passed through as the
+			// ReadFrom source rather than unwrapped down to the *os.File
+			// underneath it: there is no safe, non-reflective way to get
+			// at that underlying file (and its offset), so it's left
+			// opaque. See TestTransferWriterWriteBodySectionReaderOffset
+			// for a correctness check of a non-zero-offset section.
+			Name:           "section reader over file, non-chunked, size set",
+			BodyFunc:       newSectionReaderOverFileFunc,
+			Method:         "PUT",
+			ContentLength:  1024,
+			LimitedReader:  true,
+			ExpectedReader: sectionReaderTyp,
+		},
+		{
+			Name:           "limited reader over file, non-chunked, size set",
+			BodyFunc:       newLimitedReaderOverFileFunc,
+			Method:         "PUT",
+			ContentLength:  1024,
+			LimitedReader:  true,
+			ExpectedReader: fileTyp,
+		},
 	}
 
+	// A user-supplied Body type that opts into zero-copy writes via
+	// io.WriterTo, even though Content-Length is set (which would
+	// otherwise make writeBody wrap the Body in an io.LimitedReader).
+	t.Run("custom WriteTo body, non-chunked, size set", func(t *testing.T) {
+		body := &writerToBody{data: make([]byte, 1024)}
+		mw := &mockTransferWriterBodyWriter{}
+		tw := &transferWriter{
+			Body:          body,
+			ContentLength: 1024,
+		}
+		if err := tw.writeBody(mw); err != nil {
+			t.Fatal(err)
+		}
+		if !body.called {
+			t.Fatal("expected WriteTo to be called, but it wasn't")
+		}
+		if mw.CalledReader != nil {
+			t.Fatalf("expected ReadFrom not to be called, got reader of type %T", mw.CalledReader)
+		}
+	})
+
 	for _, tc := range cases {
 		t.Run(tc.Name, func(t *testing.T) {
 			body, cleanup, err := tc.BodyFunc()
@@ -276,3 +415,83 @@ func TestTransferWriterWriteBodyReaderTypes(t *testing.T) {
 		})
 	}
 }
+
+// TestTransferWriterWriteBodySectionReaderOffset checks that a Body backed
+// by an *io.SectionReader over a non-zero offset writes exactly the
+// sliced region, and not whatever the file descriptor's cursor happened to
+// be at.
+func TestTransferWriterWriteBodySectionReaderOffset(t *testing.T) {
+	f, err := ioutil.TempFile("", "net-http-testtransferwriterwritebodysectionreaderoffset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	f, err = os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Move the file's cursor somewhere unrelated to the section below, so
+	// a writeBody that read from the descriptor's current offset instead
+	// of the section's own offset would be caught reading the wrong bytes.
+	if _, err := f.Seek(200, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	const off, n = 100, 50
+	sr := io.NewSectionReader(f, off, n)
+
+	var out bytes.Buffer
+	tw := &transferWriter{
+		Body:          sr,
+		ContentLength: n,
+	}
+	if err := tw.writeBody(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := data[off : off+n]
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %v; want %v", out.Bytes(), want)
+	}
+}
+
+// TestTransferWriterWriteBodyContentLengthMismatch checks that writeBody
+// reports a mismatch error, rather than silently truncating or padding,
+// both when the Body has fewer bytes than the declared ContentLength and
+// when it has more.
+func TestTransferWriterWriteBodyContentLengthMismatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+	}{
+		{"short body", "short", 10},
+		{"long body", "this body is longer than declared", 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			tw := &transferWriter{
+				Body:          strings.NewReader(tt.body),
+				ContentLength: tt.contentLength,
+			}
+			err := tw.writeBody(&out)
+			wantErr := fmt.Sprintf("http: ContentLength=%d with Body length %d", tt.contentLength, len(tt.body))
+			if err == nil || err.Error() != wantErr {
+				t.Fatalf("writeBody error = %v; want %q", err, wantErr)
+			}
+		})
+	}
+}